@@ -5,14 +5,21 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 )
 
-const NOISE_THRESHOLD = 0.03
+// legacyNoiseThreshold is used only as a fallback when one side of a
+// comparison has a single run and there isn't enough data to run a
+// Welch's t-test. It mirrors the fixed percentage this tool used before
+// it could reason about run-to-run variance.
+const legacyNoiseThreshold = 0.03
 
 type Key struct {
 	Subs     int `json:"subs"`
@@ -27,11 +34,28 @@ type TestData struct {
 	Worst   int `json:"worst"`
 }
 
+// sampleSet accumulates one Average/Best/Worst value per run of a given Key.
+type sampleSet struct {
+	Best    []float64
+	Average []float64
+	Worst   []float64
+}
+
+// Diff describes the comparison of a single Key between the main and branch
+// runs. PValue is nil when there weren't enough runs on both sides to
+// compute a Welch's t-test, in which case Significant falls back to
+// legacyNoiseThreshold.
 type Diff struct {
 	Key
-	BaseAverage   int     `json:"base"`
-	BranchAverage int     `json:"branch"`
-	Diff          float64 `json:"diff"`
+	BaseAverage   int      `json:"base"`
+	BranchAverage int      `json:"branch"`
+	Diff          float64  `json:"diff"`
+	BaseRuns      int      `json:"baseRuns"`
+	BranchRuns    int      `json:"branchRuns"`
+	BaseStdDev    float64  `json:"baseStddev"`
+	BranchStdDev  float64  `json:"branchStddev"`
+	PValue        *float64 `json:"pValue,omitempty"`
+	Significant   bool     `json:"significant"`
 }
 
 type DiffData struct {
@@ -44,103 +68,501 @@ type DiffData struct {
 	} `json:"total"`
 }
 
+// runList collects repeated occurrences of a flag, e.g. -main a.log -main b.log.
+type runList []string
+
+func (r *runList) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *runList) Set(v string) error {
+	*r = append(*r, v)
+	return nil
+}
+
 func main() {
+	var mainRuns, benchRuns runList
+	flag.Var(&mainRuns, "main", "Path to a main/baseline run log, or a directory of them (repeatable)")
+	flag.Var(&benchRuns, "bench", "Path to a branch/candidate run log, or a directory of them (repeatable)")
+	alpha := flag.Float64("alpha", 0.05, "p-value threshold below which a delta is considered statistically significant")
+	minDelta := flag.Float64("min-delta", 2.0, "minimum delta between base and branch, in multiples of the standard error, required alongside -alpha to flag a record as changed")
+	format := flag.String("format", "text", "Output format: text, json, benchstat, or markdown")
 	flag.Parse()
 
-	if len(os.Args) != 3 {
-		log.Fatalf("usage: %s <main> <bench>", os.Args[0])
+	if len(mainRuns) == 0 && len(benchRuns) == 0 {
+		// Backwards compatible with the original `diffstat <main> <bench>` form.
+		args := flag.Args()
+		if len(args) != 2 {
+			log.Fatalf("usage: %s [-main path]... [-bench path]... [-format text|json|benchstat|markdown] | <main> <bench>", os.Args[0])
+		}
+		mainRuns = runList{args[0]}
+		benchRuns = runList{args[1]}
 	}
 
-	m, err := readFile(os.Args[1])
+	mainPaths, err := expandRuns(mainRuns)
 	if err != nil {
 		log.Fatal(err)
 	}
-	b, err := readFile(os.Args[2])
+	benchPaths, err := expandRuns(benchRuns)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	diff := map[string]*DiffData{}
-	for benchName := range b {
-		if _, ok := m[benchName]; !ok {
-			log.Printf("missing bench %s in main data", benchName)
+	mainAgg, err := aggregate(mainPaths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	branchAgg, err := aggregate(benchPaths)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *format == "benchstat" {
+		if err := writeBenchstat(os.Stdout, mainAgg, branchAgg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var benchNames []string
+	for name := range branchAgg {
+		benchNames = append(benchNames, name)
+	}
+	sort.Strings(benchNames)
+
+	diffs := make(map[string]*DiffData)
+	for _, name := range benchNames {
+		main, ok := mainAgg[name]
+		if !ok {
+			log.Printf("missing bench %q in main data", name)
 			continue
 		}
-		diff[benchName], err = calculateDiff(m[benchName], b[benchName])
+		d, err := calculateDiff(main, branchAgg[name], *alpha, *minDelta)
 		if err != nil {
 			log.Fatal(err)
 		}
+		diffs[name] = d
 	}
 
-	// bb, err := json.MarshalIndent(diff, "", "  ")
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// fmt.Println(string(bb))
+	switch *format {
+	case "json":
+		err = writeJSON(os.Stdout, diffs)
+	case "markdown":
+		err = writeMarkdown(os.Stdout, benchNames, diffs)
+	case "text", "":
+		err = writeText(os.Stdout, benchNames, diffs)
+	default:
+		log.Fatalf("invalid -format %q: must be one of text, json, benchstat, markdown", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	for key, d := range diff {
-		fmt.Printf("== %s ==\n", key)
-		fmt.Printf("Best: %.2f%%\n", d.Total.BestDiff*100)
-		fmt.Printf("Average: %.2f%%\n", d.Total.AverageDiff*100)
-		fmt.Printf("Worst: %.2f%%\n", d.Total.WorstDiff*100)
-		fmt.Println()
-		for _, r := range d.Records {
-			fmt.Printf("subs=%d threads=%d messages=%d base=%d branch=%d diff=%.2f%%\n",
-				r.Subs, r.Threads, r.Messages, r.BaseAverage, r.BranchAverage, r.Diff*100)
+// expandRuns turns each path into one or more run log paths, expanding any
+// directory into the (sorted) files it directly contains.
+func expandRuns(paths []string) ([]string, error) {
+	var out []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat %q: %w", p, err)
+		}
+		if !info.IsDir() {
+			out = append(out, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read directory %q: %w", p, err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			out = append(out, filepath.Join(p, e.Name()))
 		}
 	}
+	sort.Strings(out)
+	return out, nil
 }
 
-func calculateDiff(main, bench map[Key]TestData) (*DiffData, error) {
-	diff := DiffData{}
-	mBestSum, mAverageSum, mWorstSum := 0, 0, 0
-	bBestSum, bAverageSum, bWorstSum := 0, 0, 0
+// aggregate reads every run log in paths and merges them into, per bench
+// name and Key, the list of Best/Average/Worst values seen across runs.
+func aggregate(paths []string) (map[string]map[Key]*sampleSet, error) {
+	agg := make(map[string]map[Key]*sampleSet)
+	for _, path := range paths {
+		run, err := readRun(path)
+		if err != nil {
+			return nil, err
+		}
+		for benchName, keyMap := range run {
+			byKey, ok := agg[benchName]
+			if !ok {
+				byKey = make(map[Key]*sampleSet)
+				agg[benchName] = byKey
+			}
+			for key, td := range keyMap {
+				ss, ok := byKey[key]
+				if !ok {
+					ss = &sampleSet{}
+					byKey[key] = ss
+				}
+				ss.Best = append(ss.Best, float64(td.Best))
+				ss.Average = append(ss.Average, float64(td.Average))
+				ss.Worst = append(ss.Worst, float64(td.Worst))
+			}
+		}
+	}
+	return agg, nil
+}
+
+// calculateDiff compares, for every Key present in branch, the mean Average
+// across runs against the matching main Key, and flags it as changed only
+// when the delta clears both the -min-delta standard-error multiple and the
+// -alpha significance level (see isSignificant).
+func calculateDiff(main, branch map[Key]*sampleSet, alpha, minDelta float64) (*DiffData, error) {
+	diff := &DiffData{}
+	var mBestSum, mAverageSum, mWorstSum float64
+	var bBestSum, bAverageSum, bWorstSum float64
 
-	for key, b := range bench {
+	for key, b := range branch {
 		m, ok := main[key]
 		if !ok {
 			log.Printf("warning: missing key %+v in main data", key)
 			continue
 		}
 
-		// Exclude records with less than .5% difference from the output
-		d := float64(b.Average-m.Average) / float64(m.Average)
-		if d >= NOISE_THRESHOLD || d <= -NOISE_THRESHOLD {
-			diff.Records = append(diff.Records, Diff{
-				Key: Key{
-					Subs:     m.Subs,
-					Threads:  m.Threads,
-					Messages: m.Messages,
-				},
-				BaseAverage:   m.Average,
-				BranchAverage: b.Average,
-				Diff:          d,
-			})
+		mAvg, bAvg := mean(m.Average), mean(b.Average)
+		significant, pvalue, mStd, bStd := isSignificant(m.Average, b.Average, alpha, minDelta)
+
+		rec := Diff{
+			Key:           key,
+			BaseAverage:   int(math.Round(mAvg)),
+			BranchAverage: int(math.Round(bAvg)),
+			Diff:          (bAvg - mAvg) / mAvg,
+			BaseRuns:      len(m.Average),
+			BranchRuns:    len(b.Average),
+			BaseStdDev:    mStd,
+			BranchStdDev:  bStd,
+			Significant:   significant,
+		}
+		if !math.IsNaN(pvalue) {
+			rec.PValue = &pvalue
+		}
+		if significant {
+			diff.Records = append(diff.Records, rec)
 		}
 
-		mBestSum += m.Best
-		mAverageSum += m.Average
-		mWorstSum += m.Worst
-		bBestSum += b.Best
-		bAverageSum += b.Average
-		bWorstSum += b.Worst
+		mBestSum += mean(m.Best)
+		mAverageSum += mAvg
+		mWorstSum += mean(m.Worst)
+		bBestSum += mean(b.Best)
+		bAverageSum += bAvg
+		bWorstSum += mean(b.Worst)
 	}
 
 	sort.Slice(diff.Records, func(i, j int) bool {
 		return diff.Records[i].Diff > diff.Records[j].Diff
 	})
 
-	diff.Total.WorstDiff = float64(bWorstSum-mWorstSum) / float64(mWorstSum)
-	diff.Total.AverageDiff = float64(bAverageSum-mAverageSum) / float64(mAverageSum)
-	diff.Total.BestDiff = float64(bBestSum-mBestSum) / float64(mBestSum)
-	return &diff, nil
+	diff.Total.WorstDiff = (bWorstSum - mWorstSum) / mWorstSum
+	diff.Total.AverageDiff = (bAverageSum - mAverageSum) / mAverageSum
+	diff.Total.BestDiff = (bBestSum - mBestSum) / mBestSum
+	return diff, nil
+}
+
+// isSignificant reports whether the difference between main and branch is
+// large enough, relative to their run-to-run variance, to flag. With at
+// least two runs on each side it runs a two-sided Welch's t-test: the delta
+// must exceed minDelta standard errors of the difference in means, and the
+// resulting p-value must be below alpha. With fewer runs there isn't enough
+// data to estimate variance, so it falls back to legacyNoiseThreshold on the
+// raw relative delta and returns a NaN p-value.
+func isSignificant(mainVals, branchVals []float64, alpha, minDelta float64) (significant bool, pvalue, mainStdDev, branchStdDev float64) {
+	mainStdDev, branchStdDev = stddev(mainVals), stddev(branchVals)
+
+	if len(mainVals) < 2 || len(branchVals) < 2 {
+		mMean, bMean := mean(mainVals), mean(branchVals)
+		delta := math.Abs((bMean - mMean) / mMean)
+		return delta > legacyNoiseThreshold, math.NaN(), mainStdDev, branchStdDev
+	}
+
+	mMean, bMean := mean(mainVals), mean(branchVals)
+	vA, vB := variance(mainVals), variance(branchVals)
+	nA, nB := len(mainVals), len(branchVals)
+	se := math.Sqrt(vA/float64(nA) + vB/float64(nB))
+	if se == 0 {
+		return mMean != bMean, 0, mainStdDev, branchStdDev
+	}
+
+	t := (bMean - mMean) / se
+	df := welchDF(vA, nA, vB, nB)
+	pvalue = studentTPValue(t, df)
+	significant = math.Abs(t) > minDelta && pvalue < alpha
+	return significant, pvalue, mainStdDev, branchStdDev
+}
+
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// variance is the sample variance (Bessel's correction). It is 0 for fewer
+// than two samples.
+func variance(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+	m := mean(xs)
+	var ss float64
+	for _, x := range xs {
+		d := x - m
+		ss += d * d
+	}
+	return ss / float64(len(xs)-1)
+}
+
+func stddev(xs []float64) float64 {
+	return math.Sqrt(variance(xs))
+}
+
+// welchDF computes the Welch-Satterthwaite approximation of the degrees of
+// freedom for a two-sample t-test with unequal variances/sample sizes.
+func welchDF(vA float64, nA int, vB float64, nB int) float64 {
+	a := vA / float64(nA)
+	b := vB / float64(nB)
+	num := (a + b) * (a + b)
+	den := a*a/float64(nA-1) + b*b/float64(nB-1)
+	if den == 0 {
+		return float64(nA + nB - 2)
+	}
+	return num / den
+}
+
+// studentTPValue returns the two-tailed p-value of statistic t under a
+// Student's t distribution with df degrees of freedom, via the regularized
+// incomplete beta function (there is no Student's t CDF in the standard
+// library).
+func studentTPValue(t, df float64) float64 {
+	if df <= 0 {
+		return 1
+	}
+	x := df / (df + t*t)
+	return regularizedIncompleteBeta(df/2, 0.5, x)
+}
+
+// regularizedIncompleteBeta computes I_x(a, b) using the continued fraction
+// expansion from Numerical Recipes (betacf/betai).
+func regularizedIncompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betacf(a, b, x) / a
+	}
+	return 1 - front*betacf(b, a, 1-x)/b
+}
+
+func betacf(a, b, x float64) float64 {
+	const maxIter = 200
+	const eps = 3e-14
+	const tiny = 1e-300
+
+	qab := a + b
+	qap := a + 1
+	qam := a - 1
+	c := 1.0
+	d := 1 - qab*x/qap
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= maxIter; m++ {
+		m2 := float64(2 * m)
+
+		aa := float64(m) * (b - float64(m)) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		aa = -(a + float64(m)) * (qab + float64(m)) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+	return h
+}
+
+func writeJSON(w io.Writer, diffs map[string]*DiffData) error {
+	b, err := json.MarshalIndent(diffs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+func writeText(w io.Writer, names []string, diffs map[string]*DiffData) error {
+	for _, name := range names {
+		d := diffs[name]
+		if d == nil {
+			continue
+		}
+		fmt.Fprintf(w, "== %s ==\n", name)
+		fmt.Fprintf(w, "Best: %.2f%%\n", d.Total.BestDiff*100)
+		fmt.Fprintf(w, "Average: %.2f%%\n", d.Total.AverageDiff*100)
+		fmt.Fprintf(w, "Worst: %.2f%%\n", d.Total.WorstDiff*100)
+		fmt.Fprintln(w)
+		if len(d.Records) == 0 {
+			fmt.Fprintln(w, "no statistically significant changes")
+		}
+		for _, r := range d.Records {
+			if r.PValue == nil {
+				fmt.Fprintf(w, "subs=%d threads=%d messages=%d base=%d(n=%d) branch=%d(n=%d) diff=%.2f%%\n",
+					r.Subs, r.Threads, r.Messages, r.BaseAverage, r.BaseRuns, r.BranchAverage, r.BranchRuns, r.Diff*100)
+			} else {
+				fmt.Fprintf(w, "subs=%d threads=%d messages=%d base=%d(n=%d) branch=%d(n=%d) diff=%.2f%% p=%.4f\n",
+					r.Subs, r.Threads, r.Messages, r.BaseAverage, r.BaseRuns, r.BranchAverage, r.BranchRuns, r.Diff*100, *r.PValue)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func writeMarkdown(w io.Writer, names []string, diffs map[string]*DiffData) error {
+	for _, name := range names {
+		d := diffs[name]
+		if d == nil {
+			continue
+		}
+		fmt.Fprintf(w, "## %s\n\n", name)
+		fmt.Fprintf(w, "Best: %.2f%% / Average: %.2f%% / Worst: %.2f%%\n\n", d.Total.BestDiff*100, d.Total.AverageDiff*100, d.Total.WorstDiff*100)
+		if len(d.Records) == 0 {
+			fmt.Fprintln(w, "no statistically significant changes")
+			fmt.Fprintln(w)
+			continue
+		}
+		fmt.Fprintln(w, "| subs | threads | messages | base | branch | diff | p-value |")
+		fmt.Fprintln(w, "| ---: | ------: | -------: | ---: | -----: | ---: | ------: |")
+		for _, r := range d.Records {
+			p := "n/a"
+			if r.PValue != nil {
+				p = fmt.Sprintf("%.4f", *r.PValue)
+			}
+			fmt.Fprintf(w, "| %d | %d | %d | %d | %d | %.2f%% | %s |\n",
+				r.Subs, r.Threads, r.Messages, r.BaseAverage, r.BranchAverage, r.Diff*100, p)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
 }
 
-func readFile(path string) (map[string]map[Key]TestData, error) {
+// writeBenchstat emits every raw sample (not just the ones calculateDiff
+// flags as significant) in a form benchstat can read directly: one
+// `BenchmarkName  iterations  value ns/op` line per run, grouped under
+// `name: main` / `name: bench` configuration headers so benchstat treats
+// them as the two sides of the comparison. Byte-throughput (MB/s) isn't
+// tracked by this data format, so only ns/op is emitted.
+func writeBenchstat(w io.Writer, mainAgg, branchAgg map[string]map[Key]*sampleSet) error {
+	sides := []struct {
+		name string
+		agg  map[string]map[Key]*sampleSet
+	}{
+		{"main", mainAgg},
+		{"bench", branchAgg},
+	}
+	for _, side := range sides {
+		fmt.Fprintf(w, "name: %s\n", side.name)
+
+		var benchNames []string
+		for name := range side.agg {
+			benchNames = append(benchNames, name)
+		}
+		sort.Strings(benchNames)
+
+		for _, benchName := range benchNames {
+			byKey := side.agg[benchName]
+			var keys []Key
+			for key := range byKey {
+				keys = append(keys, key)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				if keys[i].Subs != keys[j].Subs {
+					return keys[i].Subs < keys[j].Subs
+				}
+				if keys[i].Threads != keys[j].Threads {
+					return keys[i].Threads < keys[j].Threads
+				}
+				return keys[i].Messages < keys[j].Messages
+			})
+
+			for _, key := range keys {
+				label := fmt.Sprintf("Benchmark%s/subs=%d/threads=%d/messages=%d-1",
+					benchmarkSafeName(benchName), key.Subs, key.Threads, key.Messages)
+				for _, v := range byKey[key].Average {
+					fmt.Fprintf(w, "%s\t1\t%.0f ns/op\n", label, v)
+				}
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+var benchstatUnsafeChars = regexp.MustCompile(`\s+`)
+
+// benchmarkSafeName turns a "== name ==" section name into something that
+// reads as a single token in a `go test -bench` style benchmark name.
+func benchmarkSafeName(name string) string {
+	return benchstatUnsafeChars.ReplaceAllString(strings.TrimSpace(name), "_")
+}
+
+// readRun parses a single run's log output into per-bench-name,
+// per-Key data. The log interleaves "== name ==" headers and JSON array
+// blocks, each line prefixed by "<n>: " from the test harness.
+func readRun(path string) (map[string]map[Key]TestData, error) {
 	r, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
+	defer r.Close()
+
 	scanner := bufio.NewScanner(r)
 	result := make(map[string]map[Key]TestData)
 	var benchName string
@@ -5,10 +5,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -16,16 +18,30 @@ import (
 
 func main() {
 	var (
-		url      string
-		user     string
-		password string
-		help     bool
+		url        string
+		user       string
+		password   string
+		help       bool
+		dryRun     bool
+		reportPath string
+		only       string
+		skip       string
+		mode       string
+		parallel   int
+		checkpoint string
 	)
 
 	flag.StringVar(&url, "url", "nats://127.0.0.1:4222", "Server url")
 	flag.StringVar(&user, "user", "", "Username")
 	flag.StringVar(&password, "password", "", "Username")
 	flag.BoolVar(&help, "help", false, "Show this help")
+	flag.BoolVar(&dryRun, "dry-run", false, "Report bad subject encodings as JSON without modifying any stream")
+	flag.StringVar(&reportPath, "report", "", "With -dry-run, write the JSON report to this file instead of stdout")
+	flag.StringVar(&only, "only", "", "Comma separated list of buckets to process, all others are skipped")
+	flag.StringVar(&skip, "skip", "", "Comma separated list of buckets to skip")
+	flag.StringVar(&mode, "mode", "all", "Store types to process: obj, kv, or all")
+	flag.IntVar(&parallel, "parallel", 4, "Number of concurrent publish workers when copying a sealed object store")
+	flag.StringVar(&checkpoint, "checkpoint", "", "Path to a checkpoint file used to resume an interrupted sealed object store repair")
 
 	flag.Parse()
 
@@ -34,26 +50,37 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Println("")
-	fmt.Println("!!! WARNING !!!")
-	fmt.Println("")
-	fmt.Println("You MUST stop any application that may be accessing the object stores while")
-	fmt.Println("this tool is running. Also, it is strongly recommended to backup the object")
-	fmt.Println("store streams before proceeding. If the tool fails, it will then be possible")
-	fmt.Println("to delete the original stream(s) and restore it(them). This all can be done")
-	fmt.Println("with the `nats` CLI tool (see `stream backup` and `stream restore` commands).")
-	fmt.Println("")
-	fmt.Print("Confirm object stores are not being used and backups made? [y/N]: ")
-
-	reader := bufio.NewReader(os.Stdin)
-	text, _ := reader.ReadString('\n')
-	text = strings.TrimSuffix(text, "\n")
-	if text != "y" && text != "Y" {
-		fmt.Println("Exiting without fixing object stores!")
+	doObj, doKV, err := parseMode(mode)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Println("")
+	onlySet := toSet(only)
+	skipSet := toSet(skip)
+
+	if !dryRun {
+		fmt.Println("")
+		fmt.Println("!!! WARNING !!!")
+		fmt.Println("")
+		fmt.Println("You MUST stop any application that may be accessing the object stores while")
+		fmt.Println("this tool is running. Also, it is strongly recommended to backup the object")
+		fmt.Println("store streams before proceeding. If the tool fails, it will then be possible")
+		fmt.Println("to delete the original stream(s) and restore it(them). This all can be done")
+		fmt.Println("with the `nats` CLI tool (see `stream backup` and `stream restore` commands).")
+		fmt.Println("")
+		fmt.Print("Confirm object stores are not being used and backups made? [y/N]: ")
+
+		reader := bufio.NewReader(os.Stdin)
+		text, _ := reader.ReadString('\n')
+		text = strings.TrimSuffix(text, "\n")
+		if text != "y" && text != "Y" {
+			fmt.Println("Exiting without fixing object stores!")
+			os.Exit(1)
+		}
+
+		fmt.Println("")
+	}
 
 	var opts []nats.Option
 	if user != "" {
@@ -72,42 +99,135 @@ func main() {
 		os.Exit(1)
 	}
 
-	var (
-		fixed        int
-		ctx          = context.Background()
-		objectStores = js.ObjectStores(ctx)
-	)
-	for info := range objectStores.Status() {
-		storeName := info.Bucket()
-		fmt.Printf("Fixing object store %q\n", storeName)
-		n, err := fixStore(ctx, js, storeName)
+	ctx := context.Background()
+
+	if dryRun {
+		report, err := buildReport(ctx, js, onlySet, skipSet, doObj, doKV)
 		if err != nil {
+			fmt.Printf("Unable to build report: %v\n", err)
+			os.Exit(1)
+		}
+		if err := writeReport(report, reportPath); err != nil {
+			fmt.Printf("Unable to write report: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var fixed int
+	if doObj {
+		objectStores := js.ObjectStores(ctx)
+		for info := range objectStores.Status() {
+			storeName := info.Bucket()
+			if !includeBucket(storeName, onlySet, skipSet) {
+				continue
+			}
+			fmt.Printf("Fixing object store %q\n", storeName)
+			n, err := fixStore(ctx, js, storeName, parallel, checkpoint)
+			if err != nil {
+				if n > 0 {
+					fmt.Printf(" => fixed %d entries, but got error: %v\n", n, err)
+				} else {
+					fmt.Printf(" => error: %v\n", err)
+				}
+				fmt.Println("")
+				os.Exit(1)
+			}
 			if n > 0 {
-				fmt.Printf(" => fixed %d entries, but got error: %v\n", n, err)
+				fmt.Printf(" => fixed %d entries\n", n)
+				fixed += n
 			} else {
-				fmt.Printf(" => error: %v\n", err)
+				fmt.Println(" => no error found!")
 			}
 			fmt.Println("")
-			os.Exit(1)
 		}
-		if n > 0 {
-			fmt.Printf(" => fixed %d entries\n", n)
-			fixed += n
-		} else {
-			fmt.Println(" => no error found!")
+	}
+	if doKV {
+		kvStores := js.KeyValueStores(ctx)
+		for info := range kvStores.Status() {
+			bucket := info.Bucket()
+			if !includeBucket(bucket, onlySet, skipSet) {
+				continue
+			}
+			fmt.Printf("Fixing KV bucket %q\n", bucket)
+			n, err := fixKVStore(ctx, js, bucket)
+			if err != nil {
+				if n > 0 {
+					fmt.Printf(" => fixed %d entries, but got error: %v\n", n, err)
+				} else {
+					fmt.Printf(" => error: %v\n", err)
+				}
+				fmt.Println("")
+				os.Exit(1)
+			}
+			if n > 0 {
+				fmt.Printf(" => fixed %d entries\n", n)
+				fixed += n
+			} else {
+				fmt.Println(" => no error found!")
+			}
+			fmt.Println("")
 		}
-		fmt.Println("")
 	}
 	fmt.Printf("\nFixed a total of %v entries!", fixed)
 }
 
-func fixStore(ctx context.Context, js jetstream.JetStream, storeName string) (int, error) {
+// parseMode validates the -mode flag and reports which store types to process.
+func parseMode(mode string) (doObj, doKV bool, err error) {
+	switch mode {
+	case "", "all":
+		return true, true, nil
+	case "obj":
+		return true, false, nil
+	case "kv":
+		return false, true, nil
+	default:
+		return false, false, fmt.Errorf("invalid -mode %q: must be one of obj, kv, all", mode)
+	}
+}
+
+// toSet turns a comma separated list of bucket names into a lookup set.
+// An empty list yields an empty (not nil) set.
+func toSet(list string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			set[s] = struct{}{}
+		}
+	}
+	return set
+}
+
+// includeBucket reports whether storeName should be processed given the
+// -only and -skip selectors. A non-empty "only" set acts as an allow-list;
+// "skip" always excludes, even from the allow-list.
+func includeBucket(storeName string, only, skip map[string]struct{}) bool {
+	if len(only) > 0 {
+		if _, ok := only[storeName]; !ok {
+			return false
+		}
+	}
+	_, skipped := skip[storeName]
+	return !skipped
+}
+
+func fixStore(ctx context.Context, js jetstream.JetStream, storeName string, parallel int, checkpointPath string) (int, error) {
 	streamName := fmt.Sprintf("OBJ_%s", storeName)
 	stream, err := js.Stream(ctx, streamName)
 	if err != nil {
 		return 0, fmt.Errorf("unable to get stream %q: %v", streamName, err)
 	}
 
+	metaSubj := fmt.Sprintf("$O.%s.M.>", storeName)
+	clean, _, err := subjectsLookClean(ctx, stream, metaSubj)
+	if err != nil {
+		return 0, err
+	}
+	if clean {
+		return 0, nil
+	}
+
 	badOnes, mr, err := collectMetaRecords(ctx, js, storeName)
 	if err != nil {
 		return 0, err
@@ -118,7 +238,11 @@ func fixStore(ctx context.Context, js jetstream.JetStream, storeName string) (in
 
 	isSealed := stream.CachedInfo().Config.Sealed
 	if isSealed {
-		return fixSealedStore(ctx, js, stream, storeName, mr)
+		fixed, err := fixSealedStore(ctx, js, stream, storeName, mr, parallel, checkpointPath)
+		if err != nil {
+			return fixed, err
+		}
+		return fixed, verifyMetaRepair(ctx, js, storeName)
 	}
 
 	metaSubjPrexix := fmt.Sprintf("$O.%s.M.", storeName)
@@ -143,57 +267,130 @@ func fixStore(ctx context.Context, js jetstream.JetStream, storeName string) (in
 			fixed++
 		}
 	}
+	if err := verifyMetaRepair(ctx, js, storeName); err != nil {
+		return fixed, err
+	}
 	return fixed, nil
 }
 
+// isCanonicalToken reports whether token is exactly the canonical
+// base64.URLEncoding form of some byte string, i.e. it would be produced
+// unchanged by EncodeToString(DecodeString(token)).
+func isCanonicalToken(token string) bool {
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	// DecodeString accepts non-zero padding bits (e.g. "Zh==", "Zi==", "Zj=="
+	// all decode to "f"), so a successful decode alone isn't enough: confirm
+	// the token is the one EncodeToString would actually produce.
+	return base64.URLEncoding.EncodeToString(decoded) == token
+}
+
+// subjectsLookClean does a single, cheap stream.Info call filtered to
+// subjectFilter and reports the number of matching subjects and whether
+// every one of them is already a canonically-encoded token. It is used to
+// short-circuit the expensive, full ordered-consumer scan in
+// collectMetaRecords/collectKVRecords for stores that show no sign of
+// corruption, and to size reports without a full scan.
+func subjectsLookClean(ctx context.Context, stream jetstream.Stream, subjectFilter string) (clean bool, total int, err error) {
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter(subjectFilter))
+	if err != nil {
+		return false, 0, fmt.Errorf("unable to get subject info for %q: %v", subjectFilter, err)
+	}
+	prefix := strings.TrimSuffix(subjectFilter, ">")
+	clean = true
+	for subj := range info.State.Subjects {
+		total++
+		if !isCanonicalToken(strings.TrimPrefix(subj, prefix)) {
+			clean = false
+		}
+	}
+	return clean, total, nil
+}
+
+// verifyMetaRepair re-requests the meta subject map for storeName and
+// fails with a diff if any meta subject still does not decode back to the
+// name recorded in its payload.
+func verifyMetaRepair(ctx context.Context, js jetstream.JetStream, storeName string) error {
+	streamName := fmt.Sprintf("OBJ_%s", storeName)
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return fmt.Errorf("unable to get stream %q for verification: %v", streamName, err)
+	}
+	clean, _, err := subjectsLookClean(ctx, stream, fmt.Sprintf("$O.%s.M.>", storeName))
+	if err != nil {
+		return err
+	}
+	if clean {
+		return nil
+	}
+	badOnes, mr, err := collectMetaRecords(ctx, js, storeName)
+	if err != nil {
+		return fmt.Errorf("unable to verify repair of %q: %v", storeName, err)
+	}
+	if badOnes == 0 {
+		return nil
+	}
+	var diffs []string
+	for _, m := range mr {
+		if m.bad {
+			diffs = append(diffs, fmt.Sprintf("  %s: expected $O.%s.M.%s", m.msg.Subject(), storeName, m.enc))
+		}
+	}
+	return fmt.Errorf("repair verification failed for object store %q, %d meta subject(s) still wrong:\n%s",
+		storeName, badOnes, strings.Join(diffs, "\n"))
+}
+
 func fixSealedStore(ctx context.Context, js jetstream.JetStream, stream jetstream.Stream,
-	storeName string, metaRecords []*metaRec) (int, error) {
+	storeName string, metaRecords []*metaRec, parallel int, checkpointPath string) (int, error) {
 
 	tmpStoreName := storeName + "_fix"
 	tmpStreamName := "OBJ_" + tmpStoreName
 	tmpChunksSubj := fmt.Sprintf("$O.%s.C.>", tmpStoreName)
 	tmpMetaSubj := fmt.Sprintf("$O.%s.M.>", tmpStoreName)
 
-	// Create the temporary stream. We use current config and "undo" config
-	// changes made by the server when sealing a stream.
+	cp, err := loadCheckpoint(checkpointPath)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read checkpoint %q: %v", checkpointPath, err)
+	}
+	resuming := cp != nil && cp.Bucket == storeName && cp.TmpStreamName == tmpStreamName
+
+	// We use current config and "undo" config changes made by the server
+	// when sealing a stream.
 	cfg := stream.CachedInfo().Config
 	cfg.Sealed = false
 	cfg.DenyDelete, cfg.DenyPurge = false, false
 	cfg.AllowRollup, cfg.AllowDirect = true, true
-	cfg.Name = tmpStreamName
-	cfg.Subjects = []string{tmpChunksSubj, tmpMetaSubj}
-	_, err := js.CreateStream(ctx, cfg)
-	if err != nil {
-		return 0, fmt.Errorf("unable to create stream %q: %v", tmpStreamName, err)
-	}
 
-	// Do a first pass where we are going to transfer all chunks to the temp stream.
 	chunkPrefix := fmt.Sprintf("$O.%s.C.", storeName)
-	cons, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
-		FilterSubjects: []string{chunkPrefix + ">"},
-	})
-	if err != nil {
-		return 0, fmt.Errorf("unable to create consumer for chunks: %v", err)
-	}
-	defer stream.DeleteConsumer(ctx, cons.CachedInfo().Name)
-
 	tmpChunkPrefix := fmt.Sprintf("$O.%s.C.", tmpStoreName)
-	for range cons.CachedInfo().NumPending {
-		msg, err := cons.Next()
-		if err != nil {
-			return 0, fmt.Errorf("unable to get next chunk: %v", err)
-		}
-		nuid := strings.TrimPrefix(msg.Subject(), chunkPrefix)
-		if nuid == "" {
-			return 0, fmt.Errorf("invalid original chunk subject %q", msg.Subject())
+
+	if !resuming {
+		// Create the temporary stream.
+		cfg.Name = tmpStreamName
+		cfg.Subjects = []string{tmpChunksSubj, tmpMetaSubj}
+		if _, err := js.CreateStream(ctx, cfg); err != nil {
+			return 0, fmt.Errorf("unable to create stream %q: %v", tmpStreamName, err)
 		}
-		tmpMsg := nats.NewMsg(tmpChunkPrefix + nuid)
-		tmpMsg.Header = msg.Headers()
-		tmpMsg.Data = msg.Data()
-		if _, err := js.PublishMsg(ctx, tmpMsg); err != nil {
-			return 0, fmt.Errorf("unable to write into %q: %v", tmpMsg.Subject, err)
+	}
+
+	// Transfer all chunks to the temp stream first, since this is the bulk of
+	// the data in a typical bucket. copyChunksParallel checkpoints its
+	// progress so an interrupted run resumes without recreating the temp
+	// stream or duplicating chunks already copied.
+	if cp == nil || cp.Phase == phaseChunks {
+		if err := copyChunksParallel(ctx, js, stream, storeName, tmpStoreName, tmpStreamName, parallel, checkpointPath); err != nil {
+			return 0, err
 		}
 	}
+	if err := saveCheckpoint(checkpointPath, &checkpoint{
+		Bucket:        storeName,
+		TmpStreamName: tmpStreamName,
+		Phase:         phaseMeta,
+	}); err != nil {
+		return 0, err
+	}
 
 	tmpMetaPrefix := fmt.Sprintf("$O.%s.M.", tmpStoreName)
 	var fixed int
@@ -213,7 +410,6 @@ func fixSealedStore(ctx context.Context, js jetstream.JetStream, stream jetstrea
 			fixed++
 		}
 	}
-	stream.DeleteConsumer(ctx, cons.CachedInfo().Name)
 
 	// Now we will delete the original stream
 	streamName := "OBJ_" + storeName
@@ -234,7 +430,7 @@ func fixSealedStore(ctx context.Context, js jetstream.JetStream, stream jetstrea
 		return 0, fmt.Errorf("unable to get reference for stream %q: %v", streamName, err)
 	}
 	// Copy things over
-	cons, err = tmpStream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+	cons, err := tmpStream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
 		FilterSubjects: []string{">"},
 	})
 	if err != nil {
@@ -276,14 +472,207 @@ func fixSealedStore(ctx context.Context, js jetstream.JetStream, stream jetstrea
 	if err := js.DeleteStream(ctx, tmpStreamName); err != nil {
 		return fixed, fmt.Errorf("unable to delete temporary stream %q: %v", tmpStreamName, err)
 	}
+	clearCheckpoint(checkpointPath)
 	return fixed, nil
 }
 
+// Checkpoint phases for a sealed object store repair, in the order they run.
+const (
+	phaseChunks = "chunks"
+	phaseMeta   = "meta"
+)
+
+// checkpoint records enough of a sealed-store repair's progress to resume
+// it without recreating the temporary stream or duplicating chunks already
+// copied.
+type checkpoint struct {
+	Bucket        string `json:"bucket"`
+	LastCopiedSeq uint64 `json:"lastCopiedSeq"`
+	TmpStreamName string `json:"tmpStreamName"`
+	Phase         string `json:"phase"`
+}
+
+// loadCheckpoint returns nil, nil when path is empty or does not exist yet.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read checkpoint %q: %v", path, err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("unable to parse checkpoint %q: %v", path, err)
+	}
+	return &cp, nil
+}
+
+func saveCheckpoint(path string, cp *checkpoint) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal checkpoint: %v", err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("unable to write checkpoint %q: %v", path, err)
+	}
+	return nil
+}
+
+func clearCheckpoint(path string) {
+	if path == "" {
+		return
+	}
+	os.Remove(path)
+}
+
+// copyChunksParallel copies every chunk message from storeName's stream
+// into tmpStoreName's stream, publishing up to parallel chunks concurrently
+// and waiting for the whole window to be acked before fetching the next
+// batch. Each published message carries a Nats-Msg-Id derived from the
+// source sequence, so a batch that is retried after a partial failure
+// de-duplicates against anything that made it through before. Progress is
+// checkpointed after every acked batch.
+func copyChunksParallel(ctx context.Context, js jetstream.JetStream, stream jetstream.Stream,
+	storeName, tmpStoreName, tmpStreamName string, parallel int, checkpointPath string) error {
+
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	chunkPrefix := fmt.Sprintf("$O.%s.C.", storeName)
+	tmpChunkPrefix := fmt.Sprintf("$O.%s.C.", tmpStoreName)
+
+	var startSeq uint64 = 1
+	if cp, err := loadCheckpoint(checkpointPath); err == nil && cp != nil &&
+		cp.Bucket == storeName && cp.TmpStreamName == tmpStreamName && cp.Phase == phaseChunks {
+		startSeq = cp.LastCopiedSeq + 1
+	}
+
+	// OptStartSeq and DeliverPolicy are immutable on an existing consumer, so
+	// CreateOrUpdateConsumer can't simply adjust a leftover one to the seq
+	// this resume needs. Delete it explicitly first instead of relying on
+	// the deferred delete below to have run on every prior exit path (it
+	// won't have, after a crash, which is exactly when resume matters).
+	consName := "objstorefix-chunks"
+	if err := stream.DeleteConsumer(ctx, consName); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return fmt.Errorf("unable to remove stale pull consumer for chunks: %v", err)
+	}
+	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Name:           consName,
+		FilterSubjects: []string{chunkPrefix + ">"},
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		DeliverPolicy:  jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:    startSeq,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create pull consumer for chunks: %v", err)
+	}
+	defer stream.DeleteConsumer(ctx, consName)
+
+	var lastCopiedSeq = startSeq - 1
+	for {
+		batch, err := cons.Fetch(parallel, jetstream.FetchMaxWait(10*time.Second))
+		if err != nil {
+			return fmt.Errorf("unable to fetch chunk batch: %v", err)
+		}
+
+		var futures []jetstream.PubAckFuture
+		var pending []jetstream.Msg
+		var n int
+		var batchLastSeq uint64
+		for msg := range batch.Messages() {
+			n++
+			md, err := msg.Metadata()
+			if err != nil {
+				return fmt.Errorf("unable to get chunk metadata: %v", err)
+			}
+			nuid := strings.TrimPrefix(msg.Subject(), chunkPrefix)
+			if nuid == "" {
+				return fmt.Errorf("invalid original chunk subject %q", msg.Subject())
+			}
+
+			tmpMsg := nats.NewMsg(tmpChunkPrefix + nuid)
+			tmpMsg.Header = msg.Headers()
+			tmpMsg.Data = msg.Data()
+			tmpMsg.Header.Set("Nats-Msg-Id", fmt.Sprintf("%s-%d", storeName, md.Sequence.Stream))
+			future, err := js.PublishMsgAsync(tmpMsg)
+			if err != nil {
+				return fmt.Errorf("unable to publish chunk into %q: %v", tmpMsg.Subject, err)
+			}
+			futures = append(futures, future)
+			pending = append(pending, msg)
+			if md.Sequence.Stream > batchLastSeq {
+				batchLastSeq = md.Sequence.Stream
+			}
+		}
+		if err := batch.Error(); err != nil {
+			return fmt.Errorf("error fetching chunk batch: %v", err)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		// Back-pressure: wait for the whole window to ack (or fail) before
+		// fetching and publishing the next batch.
+		if err := awaitPublishes(js, futures); err != nil {
+			return err
+		}
+		// Only now, once every publish in the batch is durably confirmed, ack
+		// the source chunks and advance the checkpoint. Acking earlier would
+		// let a failed publish silently drop a chunk from the pull
+		// consumer's un-acked set without it ever having reached the
+		// destination.
+		for _, msg := range pending {
+			if err := msg.Ack(); err != nil {
+				return fmt.Errorf("unable to ack chunk: %v", err)
+			}
+		}
+		lastCopiedSeq = batchLastSeq
+		if err := saveCheckpoint(checkpointPath, &checkpoint{
+			Bucket:        storeName,
+			LastCopiedSeq: lastCopiedSeq,
+			TmpStreamName: tmpStreamName,
+			Phase:         phaseChunks,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// awaitPublishes blocks until every future in the batch has been acked or
+// has failed, returning the first failure found.
+func awaitPublishes(js jetstream.JetStream, futures []jetstream.PubAckFuture) error {
+	if len(futures) == 0 {
+		return nil
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("timed out waiting for %d publish(es) to ack", len(futures))
+	}
+	for _, f := range futures {
+		select {
+		case err := <-f.Err():
+			return fmt.Errorf("publish of %q failed: %v", f.Msg().Subject, err)
+		default:
+		}
+	}
+	return nil
+}
+
 type metaRec struct {
-	msg jetstream.Msg
-	enc string
-	bad bool
-	seq uint64
+	msg  jetstream.Msg
+	name string
+	enc  string
+	bad  bool
+	seq  uint64
 }
 
 func collectMetaRecords(ctx context.Context, js jetstream.JetStream, storeName string) (int, []*metaRec, error) {
@@ -329,9 +718,10 @@ func collectMetaRecords(ctx context.Context, js jetstream.JetStream, storeName s
 		bad := encoding != goodEncoding
 
 		r := &metaRec{
-			msg: msg,
-			enc: goodEncoding,
-			bad: bad,
+			msg:  msg,
+			name: name,
+			enc:  goodEncoding,
+			bad:  bad,
 		}
 		if bad {
 			md, err := msg.Metadata()
@@ -345,3 +735,470 @@ func collectMetaRecords(ctx context.Context, js jetstream.JetStream, storeName s
 	}
 	return badOnes, metaRecords, nil
 }
+
+// decodeKVKey recovers the plaintext key from a $KV subject token. Buckets
+// fixed by older versions of this tool (or written by an older client) may
+// have encoded the key with unpadded base64, so that is tried as a fallback
+// to the canonical padded encoding.
+func decodeKVKey(token string) (string, bool) {
+	if b, err := base64.URLEncoding.DecodeString(token); err == nil {
+		return string(b), true
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(token); err == nil {
+		return string(b), true
+	}
+	return "", false
+}
+
+func fixKVStore(ctx context.Context, js jetstream.JetStream, bucket string) (int, error) {
+	streamName := fmt.Sprintf("KV_%s", bucket)
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get stream %q: %v", streamName, err)
+	}
+
+	subj := fmt.Sprintf("$KV.%s.>", bucket)
+	clean, _, err := subjectsLookClean(ctx, stream, subj)
+	if err != nil {
+		return 0, err
+	}
+	if clean {
+		return 0, nil
+	}
+
+	badOnes, kr, err := collectKVRecords(ctx, js, bucket)
+	if err != nil {
+		return 0, err
+	}
+	if badOnes == 0 {
+		return 0, nil
+	}
+
+	isSealed := stream.CachedInfo().Config.Sealed
+	if isSealed {
+		fixed, err := fixSealedKVStore(ctx, js, stream, bucket, kr)
+		if err != nil {
+			return fixed, err
+		}
+		return fixed, verifyKVRepair(ctx, js, bucket)
+	}
+
+	subjPrefix := fmt.Sprintf("$KV.%s.", bucket)
+	needsMove := keysNeedingMove(kr)
+
+	var fixed int
+	for _, r := range kr {
+		if !needsMove[r.key] {
+			// None of this key's revisions are bad, so it's already sitting
+			// under its canonical subject; leave it alone. Republishing it
+			// here too would, with History > 1, add a spurious extra
+			// revision to the key instead of just overwriting in place.
+			continue
+		}
+		correctSubj := subjPrefix + r.enc
+		correctMsg := nats.NewMsg(correctSubj)
+		// Preserve all headers, including Nats-Rollup, so rollup and history
+		// semantics are unaffected by the republish.
+		correctMsg.Header = r.msg.Headers()
+		correctMsg.Data = r.msg.Data()
+		if _, err := js.PublishMsg(ctx, correctMsg); err != nil {
+			return fixed, fmt.Errorf("unable to write into %q: %v", correctSubj, err)
+		}
+		if err := stream.DeleteMsg(ctx, r.seq); err != nil {
+			return fixed, fmt.Errorf("unable to delete message sequence %v: %v", r.seq, err)
+		}
+		if r.bad {
+			// We count as "fixed" only the ones that really had bad encoding.
+			fixed++
+		}
+	}
+	if err := verifyKVRepair(ctx, js, bucket); err != nil {
+		return fixed, err
+	}
+	return fixed, nil
+}
+
+// keysNeedingMove reports, for every decoded key appearing in records, the
+// keys that have at least one revision under a non-canonical subject. Every
+// revision of such a key needs to be replayed under the canonical subject in
+// original sequence order so the key's history stays intact and its last
+// write remains last; keys with no bad revision are already correct and
+// must be left untouched.
+func keysNeedingMove(records []*kvRec) map[string]bool {
+	needsMove := make(map[string]bool, len(records))
+	for _, r := range records {
+		if r.bad {
+			needsMove[r.key] = true
+		}
+	}
+	return needsMove
+}
+
+// verifyKVRepair re-requests the KV subject map for bucket and fails with
+// a diff if any subject still does not decode back to the canonical
+// encoding of its key.
+func verifyKVRepair(ctx context.Context, js jetstream.JetStream, bucket string) error {
+	streamName := fmt.Sprintf("KV_%s", bucket)
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return fmt.Errorf("unable to get stream %q for verification: %v", streamName, err)
+	}
+	clean, _, err := subjectsLookClean(ctx, stream, fmt.Sprintf("$KV.%s.>", bucket))
+	if err != nil {
+		return err
+	}
+	if clean {
+		return nil
+	}
+	badOnes, kr, err := collectKVRecords(ctx, js, bucket)
+	if err != nil {
+		return fmt.Errorf("unable to verify repair of %q: %v", bucket, err)
+	}
+	if badOnes == 0 {
+		return nil
+	}
+	var diffs []string
+	for _, r := range kr {
+		if r.bad {
+			diffs = append(diffs, fmt.Sprintf("  %s: expected $KV.%s.%s", r.msg.Subject(), bucket, r.enc))
+		}
+	}
+	return fmt.Errorf("repair verification failed for KV bucket %q, %d key(s) still wrong:\n%s",
+		bucket, badOnes, strings.Join(diffs, "\n"))
+}
+
+// fixSealedKVStore mirrors fixSealedStore's copy-through-temp-stream flow:
+// records are replayed onto a temporary stream under their corrected
+// subjects, the original stream is dropped and recreated, the temporary
+// stream is copied back in, and the result is resealed.
+func fixSealedKVStore(ctx context.Context, js jetstream.JetStream, stream jetstream.Stream,
+	bucket string, records []*kvRec) (int, error) {
+
+	tmpBucket := bucket + "_fix"
+	tmpStreamName := "KV_" + tmpBucket
+	tmpSubj := fmt.Sprintf("$KV.%s.>", tmpBucket)
+
+	cfg := stream.CachedInfo().Config
+	cfg.Sealed = false
+	cfg.DenyDelete, cfg.DenyPurge = false, false
+	cfg.AllowRollup, cfg.AllowDirect = true, true
+	cfg.Name = tmpStreamName
+	cfg.Subjects = []string{tmpSubj}
+	_, err := js.CreateStream(ctx, cfg)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create stream %q: %v", tmpStreamName, err)
+	}
+
+	// The original stream is deleted wholesale once this loop is done, so
+	// every record must be replayed here, not just the ones belonging to a
+	// key that needs fixing. r.enc is always the canonical subject token
+	// for the record's key, which for an untouched key is simply its
+	// existing token, so this carries unaffected keys through unchanged
+	// while re-homing every revision of a key that has a bad one.
+	tmpSubjPrefix := fmt.Sprintf("$KV.%s.", tmpBucket)
+	var fixed int
+	for _, r := range records {
+		correctSubj := tmpSubjPrefix + r.enc
+		correctMsg := nats.NewMsg(correctSubj)
+		correctMsg.Header = r.msg.Headers()
+		correctMsg.Data = r.msg.Data()
+		if _, err := js.PublishMsg(ctx, correctMsg); err != nil {
+			return 0, fmt.Errorf("unable to write into %q: %v", correctSubj, err)
+		}
+		if r.bad {
+			// We count as "fixed" only the ones that really had bad encoding.
+			fixed++
+		}
+	}
+
+	// Now we will delete the original stream
+	streamName := "KV_" + bucket
+	if err := js.DeleteStream(ctx, streamName); err != nil {
+		return 0, fmt.Errorf("unable to delete original stream %q: %v", streamName, err)
+	}
+	subjPrefix := fmt.Sprintf("$KV.%s.", bucket)
+	// Recreate the original stream
+	cfg.Name = streamName
+	cfg.Subjects = []string{subjPrefix + ">"}
+	if _, err := js.CreateStream(ctx, cfg); err != nil {
+		return 0, fmt.Errorf("unable to recreate stream %q: %v", streamName, err)
+	}
+	stream = nil
+	// Get a stream reference for our temporary stream
+	tmpStream, err := js.Stream(ctx, tmpStreamName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get reference for stream %q: %v", streamName, err)
+	}
+	// Copy things over
+	cons, err := tmpStream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{">"},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to create consumer: %v", err)
+	}
+	defer tmpStream.DeleteConsumer(ctx, cons.CachedInfo().Name)
+
+	for range cons.CachedInfo().NumPending {
+		msg, err := cons.Next()
+		if err != nil {
+			return 0, fmt.Errorf("unable to get next message: %v", err)
+		}
+		token := strings.TrimPrefix(msg.Subject(), tmpSubjPrefix)
+		if token == msg.Subject() {
+			return 0, fmt.Errorf("invalid subject %q", msg.Subject())
+		}
+		tmpMsg := nats.NewMsg(subjPrefix + token)
+		tmpMsg.Header = msg.Headers()
+		tmpMsg.Data = msg.Data()
+		if _, err := js.PublishMsg(ctx, tmpMsg); err != nil {
+			return 0, fmt.Errorf("unable to write into %q: %v", tmpMsg.Subject, err)
+		}
+	}
+	// Now seal the stream
+	cfg.Sealed = true
+	if _, err := js.UpdateStream(ctx, cfg); err != nil {
+		return fixed, fmt.Errorf("unable to seal stream %q: %v", streamName, err)
+	}
+	// Now delete the temporary stream.
+	if err := js.DeleteStream(ctx, tmpStreamName); err != nil {
+		return fixed, fmt.Errorf("unable to delete temporary stream %q: %v", tmpStreamName, err)
+	}
+	return fixed, nil
+}
+
+type kvRec struct {
+	msg jetstream.Msg
+	key string
+	enc string
+	bad bool
+	seq uint64
+}
+
+// collectKVRecords walks every revision of every key in bucket, in stream
+// sequence order, and flags the ones whose subject token is not the
+// canonical encoding of the key. Processing the full history in sequence
+// order (rather than per key) keeps each key's revisions in their original
+// relative order once republished, so the last write stays last.
+func collectKVRecords(ctx context.Context, js jetstream.JetStream, bucket string) (int, []*kvRec, error) {
+	streamName := fmt.Sprintf("KV_%s", bucket)
+	subjPrefix := fmt.Sprintf("$KV.%s.", bucket)
+	subj := subjPrefix + ">"
+
+	cons, err := js.OrderedConsumer(ctx, streamName, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subj},
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to create subscription on %q: %v", subj, err)
+	}
+	defer js.DeleteConsumer(ctx, streamName, cons.CachedInfo().Name)
+	ci, err := cons.Info(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to get consumer info for %q: %v", subj, err)
+	}
+
+	var records []*kvRec
+	var badOnes int
+
+	for range ci.NumPending {
+		msg, err := cons.Next()
+		if err != nil {
+			return badOnes, nil, fmt.Errorf("unable to get next message: %v", err)
+		}
+		token := strings.TrimPrefix(msg.Subject(), subjPrefix)
+		key, ok := decodeKVKey(token)
+		if !ok {
+			return badOnes, nil, fmt.Errorf("unable to decode key from subject %q", msg.Subject())
+		}
+		goodEncoding := base64.URLEncoding.EncodeToString([]byte(key))
+		bad := token != goodEncoding
+
+		md, err := msg.Metadata()
+		if err != nil {
+			return badOnes, nil, fmt.Errorf("unable to get message metadata: %v", err)
+		}
+
+		r := &kvRec{
+			msg: msg,
+			key: key,
+			enc: goodEncoding,
+			bad: bad,
+			seq: md.Sequence.Stream,
+		}
+		if bad {
+			badOnes++
+		}
+		records = append(records, r)
+	}
+	return badOnes, records, nil
+}
+
+// ReportEntry describes a single record whose subject encoding does not
+// match the canonical encoding of its decoded name or key.
+type ReportEntry struct {
+	Name            string `json:"name"`
+	CurrentSubject  string `json:"currentSubject"`
+	ExpectedSubject string `json:"expectedSubject"`
+	Sequence        uint64 `json:"sequence"`
+	Size            int    `json:"size"`
+	Sealed          bool   `json:"sealed"`
+}
+
+// StoreReport summarizes the bad entries found in a single object store or
+// KV bucket. Kind is "obj" or "kv".
+type StoreReport struct {
+	Kind    string        `json:"kind"`
+	Bucket  string        `json:"bucket"`
+	Sealed  bool          `json:"sealed"`
+	Total   int           `json:"total"`
+	Bad     int           `json:"bad"`
+	Entries []ReportEntry `json:"entries"`
+}
+
+// Report is the top level document written by -dry-run.
+type Report struct {
+	Stores  []StoreReport `json:"stores"`
+	Summary struct {
+		Stores    int `json:"stores"`
+		TotalMeta int `json:"totalMeta"`
+		TotalBad  int `json:"totalBad"`
+	} `json:"summary"`
+}
+
+// buildReport walks every selected object store and/or KV bucket and
+// records, without mutating anything, which records have a bad subject
+// encoding.
+func buildReport(ctx context.Context, js jetstream.JetStream, only, skip map[string]struct{}, doObj, doKV bool) (*Report, error) {
+	report := &Report{}
+	if doObj {
+		objectStores := js.ObjectStores(ctx)
+		for info := range objectStores.Status() {
+			storeName := info.Bucket()
+			if !includeBucket(storeName, only, skip) {
+				continue
+			}
+			streamName := fmt.Sprintf("OBJ_%s", storeName)
+			stream, err := js.Stream(ctx, streamName)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get stream %q: %v", streamName, err)
+			}
+			sealed := stream.CachedInfo().Config.Sealed
+
+			clean, total, err := subjectsLookClean(ctx, stream, fmt.Sprintf("$O.%s.M.>", storeName))
+			if err != nil {
+				return nil, err
+			}
+			if clean {
+				report.Stores = append(report.Stores, StoreReport{Kind: "obj", Bucket: storeName, Sealed: sealed, Total: total})
+				report.Summary.Stores++
+				report.Summary.TotalMeta += total
+				continue
+			}
+
+			badOnes, mr, err := collectMetaRecords(ctx, js, storeName)
+			if err != nil {
+				return nil, err
+			}
+
+			sr := StoreReport{
+				Kind:   "obj",
+				Bucket: storeName,
+				Sealed: sealed,
+				Total:  len(mr),
+				Bad:    badOnes,
+			}
+			metaSubjPrexix := fmt.Sprintf("$O.%s.M.", storeName)
+			for _, m := range mr {
+				if !m.bad {
+					continue
+				}
+				sr.Entries = append(sr.Entries, ReportEntry{
+					Name:            m.name,
+					CurrentSubject:  m.msg.Subject(),
+					ExpectedSubject: metaSubjPrexix + m.enc,
+					Sequence:        m.seq,
+					Size:            len(m.msg.Data()),
+					Sealed:          sealed,
+				})
+			}
+			report.Stores = append(report.Stores, sr)
+			report.Summary.Stores++
+			report.Summary.TotalMeta += len(mr)
+			report.Summary.TotalBad += badOnes
+		}
+	}
+	if doKV {
+		kvStores := js.KeyValueStores(ctx)
+		for info := range kvStores.Status() {
+			bucket := info.Bucket()
+			if !includeBucket(bucket, only, skip) {
+				continue
+			}
+			streamName := fmt.Sprintf("KV_%s", bucket)
+			stream, err := js.Stream(ctx, streamName)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get stream %q: %v", streamName, err)
+			}
+			sealed := stream.CachedInfo().Config.Sealed
+
+			clean, total, err := subjectsLookClean(ctx, stream, fmt.Sprintf("$KV.%s.>", bucket))
+			if err != nil {
+				return nil, err
+			}
+			if clean {
+				report.Stores = append(report.Stores, StoreReport{Kind: "kv", Bucket: bucket, Sealed: sealed, Total: total})
+				report.Summary.Stores++
+				report.Summary.TotalMeta += total
+				continue
+			}
+
+			badOnes, kr, err := collectKVRecords(ctx, js, bucket)
+			if err != nil {
+				return nil, err
+			}
+
+			sr := StoreReport{
+				Kind:   "kv",
+				Bucket: bucket,
+				Sealed: sealed,
+				Total:  len(kr),
+				Bad:    badOnes,
+			}
+			subjPrefix := fmt.Sprintf("$KV.%s.", bucket)
+			for _, r := range kr {
+				if !r.bad {
+					continue
+				}
+				sr.Entries = append(sr.Entries, ReportEntry{
+					Name:            r.key,
+					CurrentSubject:  r.msg.Subject(),
+					ExpectedSubject: subjPrefix + r.enc,
+					Sequence:        r.seq,
+					Size:            len(r.msg.Data()),
+					Sealed:          sealed,
+				})
+			}
+			report.Stores = append(report.Stores, sr)
+			report.Summary.Stores++
+			report.Summary.TotalMeta += len(kr)
+			report.Summary.TotalBad += badOnes
+		}
+	}
+	return report, nil
+}
+
+// writeReport marshals the report as indented JSON to path, or to stdout
+// when path is empty.
+func writeReport(report *Report, path string) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal report: %v", err)
+	}
+	if path == "" {
+		fmt.Println(string(b))
+		return nil
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("unable to write report to %q: %v", path, err)
+	}
+	return nil
+}